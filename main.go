@@ -8,27 +8,65 @@ import (
 	"log"
 	"os"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/aws/credentials"
 	"github.com/awslabs/aws-sdk-go/service/ec2"
+	"github.com/awslabs/aws-sdk-go/service/s3"
+	"github.com/awslabs/aws-sdk-go/service/sts"
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/packer"
 	"github.com/mitchellh/packer/packer/plugin"
 )
 
+// TagFilter is an arbitrary EC2 describe-images filter, keyed by filter
+// name (e.g. "tag:Environment" or "tag-key") rather than a plain tag name.
+type TagFilter struct {
+	Key    string
+	Values []string
+}
+
 type plan struct {
 	common.PackerConfig `mapstructure:",squash"`
 
-	Region    string // the AWS region containing the old AMIs
-	AccessKey string `mapstructure:"access_key"`
-	SecretKey string `mapstructure:"secret_key"`
-	Owner     string // owner of the AMIs to delete, if empty, uses the AccessKey's user
-	Role      string // the tagged role to delete old AMIs for
-	Keep      int    // the number of AMIs to keep, in addition to the newly created one
-	DryRun    bool   `mapstructure:"dry_run"`
+	Region    string   // the AWS region containing the old AMIs
+	Regions   []string // the AWS regions containing the old AMIs; if set, Region is ignored
+	AccessKey string   `mapstructure:"access_key"`
+	SecretKey string   `mapstructure:"secret_key"`
+	Token     string   // session token, for use with temporary credentials
+	Profile   string   // shared-config/credentials file profile to use instead of AccessKey/SecretKey
+	Owner     string   // owner of the AMIs to delete, if empty, uses the AccessKey's user
+
+	// AssumeRoleARN, if set, is assumed via STS before talking to EC2,
+	// using the static/profile credentials above as the base session. This
+	// lets a single central account run cleanup against many target
+	// accounts without long-lived keys in each of them.
+	AssumeRoleARN         string `mapstructure:"assume_role_arn"`
+	AssumeRoleSessionName string `mapstructure:"assume_role_session_name"`
+	AssumeRoleExternalID  string `mapstructure:"assume_role_external_id"`
+
+	// Role is a deprecated shortcut for Tags["Role"]. New configs should
+	// use Tags or TagFilters instead.
+	Role string
+
+	Tags       map[string]string `mapstructure:"tags"`        // tag name/value pairs the AMIs must match
+	TagFilters []TagFilter       `mapstructure:"tag_filters"` // arbitrary EC2 filters, e.g. tag-key presence or multi-value tags
+
+	Keep   int    // the number of AMIs to keep per region, in addition to the newly created one
+	MaxAge string `mapstructure:"max_age"` // keep AMIs younger than this, parsed with time.ParseDuration
+	DryRun bool   `mapstructure:"dry_run"`
+
+	// DeleteS3Backing controls whether the S3 manifest and part objects
+	// backing an instance-store (S3-backed) AMI are deleted along with the
+	// image. Defaults to false so buckets shared across images aren't
+	// pruned by accident.
+	DeleteS3Backing bool `mapstructure:"delete_s3_backing"`
 
-	tpl *packer.ConfigTemplate
+	tpl    *packer.ConfigTemplate
+	maxAge time.Duration // parsed MaxAge
 }
 
 func (p *plan) Prepare(raw ...interface{}) error {
@@ -48,11 +86,16 @@ func (p *plan) Prepare(raw ...interface{}) error {
 	// I must be missing something, but
 	// this is how all the standard provisioners do it. :/
 	templates := map[string]*string{
-		"region":     &p.Region,
-		"access_key": &p.AccessKey,
-		"secret_key": &p.SecretKey,
-		"owner":      &p.Owner,
-		"role":       &p.Role,
+		"region":                   &p.Region,
+		"access_key":               &p.AccessKey,
+		"secret_key":               &p.SecretKey,
+		"token":                    &p.Token,
+		"profile":                  &p.Profile,
+		"owner":                    &p.Owner,
+		"role":                     &p.Role,
+		"assume_role_arn":          &p.AssumeRoleARN,
+		"assume_role_session_name": &p.AssumeRoleSessionName,
+		"assume_role_external_id":  &p.AssumeRoleExternalID,
 	}
 
 	for n, ptr := range templates {
@@ -62,11 +105,37 @@ func (p *plan) Prepare(raw ...interface{}) error {
 			errs = packer.MultiErrorAppend(errs, fmt.Errorf("error processing %s: %s", n, err))
 		}
 	}
-	if p.Role == "" {
-		errs = packer.MultiErrorAppend(errs, fmt.Errorf("missing rmami provisioner parameter role"))
+	for i, r := range p.Regions {
+		processed, err := p.tpl.Process(r, nil)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("error processing regions[%d]: %s", i, err))
+			continue
+		}
+		p.Regions[i] = processed
+	}
+	for k, v := range p.Tags {
+		processed, err := p.tpl.Process(v, nil)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("error processing tags[%s]: %s", k, err))
+			continue
+		}
+		p.Tags[k] = processed
+	}
+	for i := range p.TagFilters {
+		for j, v := range p.TagFilters[i].Values {
+			processed, err := p.tpl.Process(v, nil)
+			if err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("error processing tag_filters[%d].values[%d]: %s", i, j, err))
+				continue
+			}
+			p.TagFilters[i].Values[j] = processed
+		}
+	}
+	if p.Role == "" && len(p.Tags) == 0 && len(p.TagFilters) == 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("missing rmami provisioner parameter tags (or the deprecated role)"))
 	}
-	if p.Region == "" {
-		errs = packer.MultiErrorAppend(errs, fmt.Errorf("missing rmami provisioner parameter region"))
+	if p.Region == "" && len(p.Regions) == 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("missing rmami provisioner parameter region or regions"))
 	}
 	if errs != nil && len(errs.Errors) > 0 {
 		return errs
@@ -75,12 +144,23 @@ func (p *plan) Prepare(raw ...interface{}) error {
 	if p.Owner == "" {
 		p.Owner = "self"
 	}
+	if p.Keep == 0 && p.MaxAge == "" {
+		return errors.New("rmami provisioner must set keep, max_age, or both")
+	}
 	// There's no technical reason we can't delete all the old AMIs (keep==0 or keep==1),
 	// but it's a bad idea, and it could happen by accident if
-	// keep is left out of the packer config. Prevent that.
-	if p.Keep < 2 {
+	// keep is left out of the packer config. Prevent that. This only applies
+	// when keep is actually in use; max_age alone is fine with keep==0.
+	if p.Keep != 0 && p.Keep < 2 {
 		return errors.New("rmami provisioner parameter keep must be at least 2")
 	}
+	if p.MaxAge != "" {
+		d, err := time.ParseDuration(p.MaxAge)
+		if err != nil {
+			return fmt.Errorf("error parsing rmami provisioner parameter max_age: %s", err)
+		}
+		p.maxAge = d
+	}
 
 	// TODO: template interpolation
 	return nil
@@ -91,24 +171,153 @@ func sayf(ui packer.Ui, msg string, v ...interface{}) {
 	ui.Say(fmt.Sprintf(msg, v...))
 }
 
+// regions returns the effective list of regions to operate on, preferring
+// Regions over the deprecated singular Region.
+func (p *plan) regions() []string {
+	if len(p.Regions) > 0 {
+		return p.Regions
+	}
+	return []string{p.Region}
+}
+
+// filters translates Tags, TagFilters, and the deprecated Role shortcut
+// into the EC2 filters used to search for candidate AMIs.
+func (p *plan) filters() []*ec2.Filter {
+	var filters []*ec2.Filter
+	if p.Role != "" {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:Role"),
+			Values: []*string{aws.String(p.Role)},
+		})
+	}
+	for k, v := range p.Tags {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + k),
+			Values: []*string{aws.String(v)},
+		})
+	}
+	for _, tf := range p.TagFilters {
+		values := make([]*string, len(tf.Values))
+		for i, v := range tf.Values {
+			values[i] = aws.String(v)
+		}
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(tf.Key),
+			Values: values,
+		})
+	}
+	return filters
+}
+
+// creds builds the credentials to use against region, honoring Profile and,
+// if AssumeRoleARN is set, assuming that role via STS using the
+// static/profile credentials as the base session.
+func (p *plan) creds(region string) (*credentials.Credentials, error) {
+	base := aws.DetectCreds(p.AccessKey, p.SecretKey, p.Token)
+	if p.Profile != "" {
+		base = credentials.NewSharedCredentials("", p.Profile)
+	}
+	if p.AssumeRoleARN == "" {
+		return base, nil
+	}
+
+	sessionName := p.AssumeRoleSessionName
+	if sessionName == "" {
+		sessionName = "packer-provisioner-rmami"
+	}
+	in := sts.AssumeRoleInput{
+		RoleARN:         aws.String(p.AssumeRoleARN),
+		RoleSessionName: aws.String(sessionName),
+	}
+	if p.AssumeRoleExternalID != "" {
+		in.ExternalID = aws.String(p.AssumeRoleExternalID)
+	}
+
+	svc := sts.New(&aws.Config{Credentials: base, Region: region})
+	resp, err := svc.AssumeRole(&in)
+	if err != nil {
+		return nil, fmt.Errorf("error assuming role %q: %s", p.AssumeRoleARN, err)
+	}
+
+	return credentials.NewStaticCredentials(
+		*resp.Credentials.AccessKeyID,
+		*resp.Credentials.SecretAccessKey,
+		*resp.Credentials.SessionToken,
+	), nil
+}
+
+// describeFilters renders filters for a human-readable log line.
+func describeFilters(filters []*ec2.Filter) string {
+	if len(filters) == 0 {
+		return "no filters"
+	}
+	parts := make([]string, len(filters))
+	for i, f := range filters {
+		var values []string
+		for _, v := range f.Values {
+			values = append(values, *v)
+		}
+		parts[i] = fmt.Sprintf("%s=%s", *f.Name, strings.Join(values, ","))
+	}
+	return strings.Join(parts, ", ")
+}
+
 func (p *plan) Provision(ui packer.Ui, comm packer.Communicator) error {
-	sayf(ui, "Searching for AMIs in %q belonging to owner %q with tagged role %q", p.Region, p.Owner, p.Role)
+	regions := p.regions()
+
+	// ui.Say is not documented as safe for concurrent use, so every
+	// goroutine below funnels through sayf while holding uiLock.
+	var uiLock sync.Mutex
+	safeSayf := func(msg string, v ...interface{}) {
+		uiLock.Lock()
+		defer uiLock.Unlock()
+		sayf(ui, msg, v...)
+	}
+
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var errs *packer.MultiError
+
+	for _, region := range regions {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			if err := p.provisionRegion(region, safeSayf); err != nil {
+				errLock.Lock()
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("region %q: %s", region, err))
+				errLock.Unlock()
+			}
+		}(region)
+	}
+	wg.Wait()
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// provisionRegion prunes old AMIs in a single region. It is safe to call
+// concurrently for different regions; say is expected to serialize access
+// to the shared packer.Ui.
+func (p *plan) provisionRegion(region string, say func(string, ...interface{})) error {
+	filters := p.filters()
+	say("Searching for AMIs in %q belonging to owner %q matching %s", region, p.Owner, describeFilters(filters))
 
-	creds := aws.DetectCreds(p.AccessKey, p.SecretKey, "")
+	creds, err := p.creds(region)
+	if err != nil {
+		return err
+	}
 	cfg := aws.Config{
 		Credentials: creds,
-		Region:      p.Region,
+		Region:      region,
 	}
 	svc := ec2.New(&cfg)
+	s3svc := s3.New(&cfg)
 
 	in := ec2.DescribeImagesInput{
-		Owners: []*string{aws.String(p.Owner)},
-		Filters: []*ec2.Filter{
-			{
-				Name:   aws.String("tag:Role"),
-				Values: []*string{aws.String(p.Role)},
-			},
-		},
+		Owners:  []*string{aws.String(p.Owner)},
+		Filters: filters,
 	}
 
 	resp, err := svc.DescribeImages(&in)
@@ -128,23 +337,34 @@ func (p *plan) Provision(ui packer.Ui, comm packer.Communicator) error {
 	sort.Sort(imgs)
 
 	if len(imgs) <= p.Keep {
-		sayf(ui, "Found %d AMIs. Keeping all of them.", len(imgs))
+		say("[%s] Found %d AMIs. Keeping all of them.", region, len(imgs))
 		return nil
 	}
 
-	sayf(ui, "Found %d AMIs. Keeping most recent %d.", len(imgs), p.Keep)
-	for _, img := range imgs[:p.Keep] {
-		sayf(ui, "Keeping %v, created at %v", img.id, img.created)
+	say("[%s] Found %d AMIs. Keeping most recent %d plus anything younger than %q.", region, len(imgs), p.Keep, p.MaxAge)
+
+	cutoff := time.Now().Add(-p.maxAge)
+	var toDelete images
+	for idx, img := range imgs {
+		switch {
+		case idx < p.Keep:
+			say("[%s] Keeping %v, created at %v (within keep count)", region, img.id, img.created)
+		case p.maxAge > 0 && img.created.After(cutoff):
+			say("[%s] Keeping %v, created at %v (within age window)", region, img.id, img.created)
+		default:
+			toDelete = append(toDelete, img)
+		}
 	}
 
-	for _, img := range imgs[p.Keep:] {
+	for _, img := range toDelete {
 		if p.DryRun {
-			sayf(ui, "DRY RUN: Would delete %v, created at %v", img.id, img.created)
+			say("[%s] DRY RUN: Would delete %v, created at %v", region, img.id, img.created)
 		} else {
-			sayf(ui, "Deleting %v, created at %v", img.id, img.created)
-			if err := img.delete(ui, svc); err != nil {
-				// Don't bother trying to accumulate multiple errors.
-				// If one fails, the others probably will too.
+			say("[%s] Deleting %v, created at %v", region, img.id, img.created)
+			if err := img.delete(say, svc, s3svc, p.DeleteS3Backing, p.Owner); err != nil {
+				// Don't bother trying to accumulate multiple snapshot/image
+				// errors within a region. If one fails, the others probably
+				// will too. Per-region errors are aggregated by the caller.
 				return err
 			}
 		}
@@ -170,7 +390,13 @@ func main() {
 type image struct {
 	id          string
 	snapshotIds []string
-	created     time.Time
+
+	// s3Bucket and s3ManifestKey are set instead of snapshotIds for
+	// instance-store (S3-backed) AMIs.
+	s3Bucket      string
+	s3ManifestKey string
+
+	created time.Time
 }
 
 type images []image
@@ -196,30 +422,138 @@ func newImage(img *ec2.Image) (i image, err error) {
 		}
 	}
 	if len(i.snapshotIds) == 0 {
-		err = fmt.Errorf("AMI %v does not have any associated snapshot IDs. rmami only supports EBS-based AMIs right now.", i.id)
-		return
+		if img.ImageLocation == nil {
+			err = fmt.Errorf("AMI %v has no snapshot IDs and no image location; can't tell how it's backed", i.id)
+			return
+		}
+		bucket, key, ok := splitImageLocation(*img.ImageLocation)
+		if !ok {
+			err = fmt.Errorf("AMI %v has unrecognized image location %q", i.id, *img.ImageLocation)
+			return
+		}
+		i.s3Bucket, i.s3ManifestKey = bucket, key
 	}
 	return
 }
 
-func (i image) delete(ui packer.Ui, svc *ec2.EC2) error {
-	sayf(ui, "\t* deregistering image %v", i.id)
-	_, err := svc.DeregisterImage(
-		&ec2.DeregisterImageInput{ImageID: aws.String(i.id)},
-	)
+// splitImageLocation splits an EC2 ImageLocation of the form
+// "bucket/path/to/image.manifest.xml" (as returned for instance-store AMIs)
+// into its bucket and manifest key.
+func splitImageLocation(loc string) (bucket, key string, ok bool) {
+	parts := strings.SplitN(loc, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// delete re-describes i immediately before tearing it down, so that it
+// acts on the authoritative, current set of block device mappings rather
+// than the snapshot from when imgs was first listed: mappings that were
+// nil at list time, or added later, would otherwise leave orphan
+// snapshots behind. owner is the configured Owner; images that turn out
+// to be owned by someone else (e.g. shared into this account) are left
+// alone rather than deregistered out from under their owner.
+func (i image) delete(say func(string, ...interface{}), svc *ec2.EC2, s3svc *s3.S3, deleteS3Backing bool, owner string) error {
+	descResp, err := svc.DescribeImages(&ec2.DescribeImagesInput{
+		ImageIDs: []*string{aws.String(i.id)},
+	})
 	if err != nil {
 		return err
 	}
+	if len(descResp.Images) == 0 {
+		say("\t* %v no longer exists; nothing to do", i.id)
+		return nil
+	}
+	img := descResp.Images[0]
 
-	for _, sid := range i.snapshotIds {
-		sayf(ui, "\t* deleting snapshot %v", sid)
-		_, err := svc.DeleteSnapshot(
-			&ec2.DeleteSnapshotInput{SnapshotID: aws.String(sid)},
-		)
-		if err != nil {
-			return err
+	if owner != "self" && owner != "" && img.OwnerID != nil && *img.OwnerID != owner {
+		say("\t* skipping %v: owned by %v, not %v; likely shared into this account", i.id, *img.OwnerID, owner)
+		return nil
+	}
+
+	say("\t* deregistering image %v", i.id)
+	if _, err := svc.DeregisterImage(&ec2.DeregisterImageInput{ImageID: aws.String(i.id)}); err != nil {
+		return err
+	}
+
+	var errs *packer.MultiError
+	for _, b := range img.BlockDeviceMappings {
+		if b.EBS == nil || b.EBS.SnapshotID == nil {
+			continue
+		}
+		sid := *b.EBS.SnapshotID
+		say("\t* deleting snapshot %v", sid)
+		if _, err := svc.DeleteSnapshot(&ec2.DeleteSnapshotInput{SnapshotID: aws.String(sid)}); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("snapshot %v: %s", sid, err))
+		}
+	}
+
+	if i.s3Bucket != "" {
+		if !deleteS3Backing {
+			say("\t* leaving S3-backed image data at s3://%s/%s alone (delete_s3_backing is false)", i.s3Bucket, i.s3ManifestKey)
+		} else if err := deleteS3Manifest(say, s3svc, i.s3Bucket, i.s3ManifestKey); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
 		}
 	}
 
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
 	return nil
 }
+
+// deleteS3Manifest deletes the manifest object and all of its "*.part.*"
+// chunks for an instance-store AMI. The prefix used to list candidates is
+// the manifest's own basename (with the ".manifest.xml" suffix trimmed),
+// not its containing directory: a bare directory or bucket-root prefix is
+// shared by every other bundle living alongside it, and deleting by that
+// broader prefix would take out unrelated images' data too.
+func deleteS3Manifest(say func(string, ...interface{}), svc *s3.S3, bucket, manifestKey string) error {
+	base := strings.TrimSuffix(manifestKey, ".manifest.xml")
+
+	say("\t* listing s3://%s/%s* for manifest and part objects", bucket, base)
+
+	var marker string
+	for {
+		in := &s3.ListObjectsInput{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(base),
+		}
+		if marker != "" {
+			in.Marker = aws.String(marker)
+		}
+		resp, err := svc.ListObjects(in)
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range resp.Contents {
+			if obj.Key == nil {
+				continue
+			}
+			key := *obj.Key
+			if key != manifestKey && !strings.HasPrefix(key, base+".part.") {
+				continue
+			}
+			say("\t* deleting s3://%s/%s", bucket, key)
+			if _, err := svc.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			}); err != nil {
+				return err
+			}
+		}
+
+		if resp.IsTruncated == nil || !*resp.IsTruncated {
+			return nil
+		}
+		if resp.NextMarker != nil {
+			marker = *resp.NextMarker
+		} else if len(resp.Contents) > 0 {
+			marker = *resp.Contents[len(resp.Contents)-1].Key
+		} else {
+			return nil
+		}
+	}
+}